@@ -2,21 +2,293 @@ package service
 
 import (
 	"bufio"
+	"bytes"
 	"cham/cham"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	GATE_OPEN uint8 = iota
 )
 
+// frame header: magic(4) + type(1) + length(4), bigendian, modeled on
+// Tailscale's DERP framing so unknown types can always be resynced by
+// reading exactly `length` bytes.
+const (
+	frameMagic     uint32 = 0x4348414D // "CHAM"
+	frameHeaderLen int    = 4 + 1 + 4
+)
+
+// known frame types; anything not registered with RegisterFrameType is
+// treated like TYPE_UNKNOWN and its payload is discarded.
+//
+// There's no TYPE_AUTH: Conf.SetAuth's HMAC handshake is a deliberately
+// out-of-band raw byte exchange (see Gate.authenticate) that runs before
+// the session is registered and before this framed dispatch loop starts
+// reading at all, so it has no frame type to carry it.
+const (
+	TYPE_DATA uint8 = iota
+	TYPE_KEEPALIVE
+	TYPE_CLOSE
+	TYPE_UNKNOWN uint8 = 0xff
+)
+
+// Codec frames raw payloads on the wire. It is a lighter alternative to the
+// native magic+type+length control protocol above, for clients that only
+// ever exchange plain payloads: legacy TCP clients and browsers that can't
+// produce our control frames. A nil Codec on Conf keeps the native protocol.
+type Codec interface {
+	// ReadFrame reads one frame and returns its payload. Implementations
+	// must reject (without allocating) any length field claiming more
+	// than maxFrameSize, the same bound serveNative enforces for the
+	// native protocol.
+	ReadFrame(r *bufio.Reader, maxFrameSize int) ([]byte, error)
+	WriteFrame(w *bufio.Writer, data []byte) error
+}
+
+// handshaker is implemented by codecs that need to negotiate something
+// before the first frame, such as the WebSocket HTTP upgrade.
+type handshaker interface {
+	Handshake(rw *bufio.ReadWriter) error
+}
+
+type lenPrefix16Codec struct{}
+
+// LenPrefix16 is the original bigendian 2-byte-length + data framing.
+var LenPrefix16 Codec = lenPrefix16Codec{}
+
+func (lenPrefix16Codec) ReadFrame(r *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(head)
+	if int(length) > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (lenPrefix16Codec) WriteFrame(w *bufio.Writer, data []byte) error {
+	head := make([]byte, 2)
+	binary.BigEndian.PutUint16(head, uint16(len(data)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+type lenPrefix32Codec struct{}
+
+// LenPrefix32 is LenPrefix16 with a 4-byte length, for payloads that can
+// exceed 64KB.
+var LenPrefix32 Codec = lenPrefix32Codec{}
+
+func (lenPrefix32Codec) ReadFrame(r *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head)
+	if length > uint32(maxFrameSize) {
+		return nil, errFrameTooLarge
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (lenPrefix32Codec) WriteFrame(w *bufio.Writer, data []byte) error {
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, uint32(len(data)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+const wsOpcodeClose = 0x8
+
+type webSocketCodec struct{}
+
+// WebSocket speaks plain (unfragmented, text/binary) RFC 6455 frames after
+// the HTTP upgrade, so a browser dashboard can connect directly to a gate.
+var WebSocket Codec = webSocketCodec{}
+
+func (webSocketCodec) Handshake(rw *bufio.ReadWriter) error {
+	req, err := http.ReadRequest(rw.Reader)
+	if err != nil {
+		return err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return errors.New("service: missing Sec-WebSocket-Key")
+	}
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	if _, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+func (webSocketCodec) ReadFrame(r *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > uint64(maxFrameSize) {
+		return nil, errFrameTooLarge
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range data {
+			data[i] ^= maskKey[i%4]
+		}
+	}
+	if opcode == wsOpcodeClose {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+func (webSocketCodec) WriteFrame(w *bufio.Writer, data []byte) error {
+	var head []byte
+	switch length := len(data); {
+	case length < 126:
+		head = []byte{0x82, byte(length)}
+	case length <= 0xffff:
+		head = make([]byte, 4)
+		head[0], head[1] = 0x82, 126
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+	default:
+		head = make([]byte, 10)
+		head[0], head[1] = 0x82, 127
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+	}
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+var errSessionClosed = errors.New("service: session closed")
+
+const authReplySize = sha256.Size
+
+// defaultSendQueue bounds how many not-yet-flushed frames a session's
+// writer goroutine will hold before Conf.sendQueue overflow policy kicks in.
+const defaultSendQueue = 64
+
+// defaultMaxFrameSize bounds how large a single length-prefixed frame a
+// session's length field is allowed to claim, so a forged or corrupt
+// header can't make the gate allocate gigabytes (or wrap past int on
+// 32-bit platforms) before it even reads the body.
+const defaultMaxFrameSize = 1 << 20 // 1MB
+
+var errFrameTooLarge = errors.New("service: frame exceeds max frame size")
+
+// OverflowPolicy decides what happens when a session's send queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowKick drops the session when its queue is full.
+	OverflowKick OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued frame to make room for
+	// the new one, keeping the session connected.
+	OverflowDropOldest
+)
+
+// Stats are cumulative counters exposed via Gate.Stats().
+type Stats struct {
+	SessionsDropped        uint64
+	FramesDroppedQueueFull uint64
+	BytesWritten           uint64
+	BytesRead              uint64
+}
+
+// authChallengeSize is the length of the random challenge the gate sends
+// before a session is trusted.
+const authChallengeSize = 32
+
+// FrameHandler handles the payload of one frame for a session. Returning
+// an error closes the session, the same as a read/write failure would.
+type FrameHandler func(*Session, []byte) error
+
+type frameHeader struct {
+	magic  uint32
+	typ    uint8
+	length uint32
+}
+
 var (
 	bufioReaderPool sync.Pool
 	bufioWriterPool sync.Pool
+	gatesMutex      sync.RWMutex
 	GATES           map[cham.Address]*Gate
 )
 
@@ -26,48 +298,215 @@ type ClientMsg struct {
 }
 
 type Conf struct {
-	address   string //127.0.0.1:8000
-	maxclient uint32 // 0 -> no limit
+	address        string //127.0.0.1:8000
+	maxclient      uint32 // 0 -> no limit
+	sharedKey      []byte // HMAC key for the auth handshake
+	authTimeout    time.Duration
+	authRequired   bool
+	codec          Codec // nil -> native magic+type+length protocol
+	sendQueue      int   // 0 -> defaultSendQueue
+	overflowPolicy OverflowPolicy
+	tlsConfig      *tls.Config // nil -> plaintext
+	goodbye        []byte      // payload sent with TYPE_CLOSE on Shutdown
+	maxFrameSize   int         // 0 -> defaultMaxFrameSize
 }
 
 type Gate struct {
-	rwmutex   *sync.RWMutex
-	source    cham.Address
-	clinetnum uint32
-	maxclient uint32
-	quit      chan struct{}
-	sessions  map[uint32]*Session
+	// atomic counters first so they stay 64-bit aligned on 32-bit platforms.
+	sessionsDropped        uint64
+	framesDroppedQueueFull uint64
+	bytesWritten           uint64
+	bytesRead              uint64
+
+	rwmutex       *sync.RWMutex
+	source        cham.Address
+	dest          cham.Address
+	conf          *Conf
+	clinetnum     uint32
+	maxclient     uint32
+	quit          chan struct{}
+	sessions      map[uint32]*Session
+	frameHandlers map[uint8]FrameHandler
+	tlsEnabled    bool
+	tlsConfig     atomic.Value // stores *tls.Config, swappable via ReloadTLS
+	listener      net.Listener
+	wg            sync.WaitGroup
+	goodbye       []byte
 }
 
 type Session struct {
-	sessionid uint32
-	conn      net.Conn
-	brw       *bufio.ReadWriter
+	sessionid     uint32
+	conn          net.Conn
+	brw           *bufio.ReadWriter
+	codec         Codec
+	gate          *Gate
+	authenticated bool
+	authTime      time.Time
+	sendq         chan []byte
+	sendDone      chan struct{}
+	tlsState      *tls.ConnectionState
+	closeOnce     sync.Once
 }
 
+// SessionInfo is the authenticated identity metadata for a session, handed
+// back to cham.Service handlers so they know who a ClientMsg came from.
+type SessionInfo struct {
+	SessionID     uint32
+	Authenticated bool
+	AuthTime      time.Time
+}
+
+// Close tears the session down: it stops the writer goroutine, recycles
+// the buffered reader/writer, and closes the connection. It's idempotent:
+// only the first call does the work. (kick does not call Close; it only
+// closes the conn, and the session's serve() goroutine then calls
+// closeSession, which calls Close.)
 func (s *Session) Close() {
-	putBufioReader(s.brw.Reader)
-	putBufioWriter(s.brw.Writer)
-	s.conn.Close()
+	s.closeOnce.Do(func() {
+		close(s.sendq)
+		<-s.sendDone
+		putBufioReader(s.brw.Reader)
+		putBufioWriter(s.brw.Writer)
+		s.conn.Close()
+	})
 }
 
+// Write is a direct, unqueued write that flushes on the caller's goroutine,
+// bypassing the send queue and the session's writer goroutine.
 func (s *Session) Write(data []byte) {
 	s.brw.Write(data)
 	s.brw.Flush()
 }
 
+// WriteFrame encodes one payload through the session's Codec (or as a
+// native TYPE_DATA frame when no Codec is set) and queues it on the
+// session's writer goroutine. It reports false if the payload could not be
+// encoded or the frame could not be queued (see Gate.enqueue for what a
+// full queue does).
+func (s *Session) WriteFrame(data []byte) bool {
+	frame, err := encodeWithCodec(s.codec, TYPE_DATA, data)
+	if err != nil {
+		return false
+	}
+	return s.gate.enqueue(s, frame)
+}
+
+// encodeWithCodec frames data the way a session configured with codec
+// expects to read it off the wire: through codec.WriteFrame, or as a
+// native magic+type+length frame when codec is nil. typ is only
+// meaningful for the native protocol — a Codec has no concept of frame
+// type, just payloads.
+func encodeWithCodec(codec Codec, typ uint8, data []byte) ([]byte, error) {
+	if codec == nil {
+		return encodeFrame(typ, data), nil
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	if err := codec.WriteFrame(bw, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeLoop drains the session's send queue and writes frames on a
+// dedicated goroutine, so a stalled client never blocks a cham dispatcher.
+func (s *Session) writeLoop() {
+	defer close(s.sendDone)
+	for data := range s.sendq {
+		if _, err := s.brw.Write(data); err == nil {
+			if err := s.brw.Flush(); err == nil {
+				atomic.AddUint64(&s.gate.bytesWritten, uint64(len(data)))
+			}
+		}
+	}
+}
+
 func NewConf(address string, maxclient uint32) *Conf {
-	return &Conf{address, maxclient}
+	return &Conf{address: address, maxclient: maxclient}
+}
+
+// SetAuth configures the pre-registration auth handshake. When required is
+// true, the gate will challenge every new connection and drop it unless it
+// replies with HMAC-SHA256(sharedKey, challenge||sessionID) within timeout;
+// when required is false, no challenge is sent at all. It has no
+// effect when Conf.codec negotiates its own handshake (e.g. WebSocket) —
+// the native challenge can't be interleaved with one, so such codecs are
+// responsible for their own authentication.
+func (c *Conf) SetAuth(sharedKey []byte, timeout time.Duration, required bool) {
+	c.sharedKey = sharedKey
+	c.authTimeout = timeout
+	c.authRequired = required
+}
+
+// SetCodec selects the wire framing for this gate's sessions: LenPrefix16,
+// LenPrefix32, or WebSocket. The zero value keeps the native control protocol.
+func (c *Conf) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+// SetSendQueue bounds each session's outgoing frame queue and picks what
+// happens when it fills up: OverflowKick (default) or OverflowDropOldest.
+func (c *Conf) SetSendQueue(size int, policy OverflowPolicy) {
+	c.sendQueue = size
+	c.overflowPolicy = policy
+}
+
+// SetTLS turns the gate's listener into a TLS listener. The zero value
+// (nil) keeps plaintext TCP.
+func (c *Conf) SetTLS(cfg *tls.Config) {
+	c.tlsConfig = cfg
+}
+
+// SetMaxFrameSize bounds how large a single frame's length field is allowed
+// to claim, for both the native protocol and any configured Codec. A
+// session whose header claims more than this is closed rather than
+// trusted with a large allocation. size <= 0 keeps defaultMaxFrameSize.
+func (c *Conf) SetMaxFrameSize(size int) {
+	c.maxFrameSize = size
+}
+
+// SetGoodbye sets the payload sent with the TYPE_CLOSE frame Shutdown gives
+// every session before it waits for them to drain. It has no effect when
+// Conf.codec is set, since a Codec speaks plain payloads with no TYPE_CLOSE
+// of its own.
+func (c *Conf) SetGoodbye(payload []byte) {
+	c.goodbye = payload
 }
 
 func NewClientMsg(session uint32, data []byte) *ClientMsg {
 	return &ClientMsg{session, data}
 }
 
-func newSession(sessionid uint32, conn net.Conn) *Session {
+func newSession(sessionid uint32, conn net.Conn, codec Codec, gate *Gate) *Session {
 	br := newBufioReader(conn)
 	bw := newBufioWriter(conn)
-	return &Session{sessionid, conn, bufio.NewReadWriter(br, bw)}
+	queueSize := defaultSendQueue
+	if gate.conf != nil && gate.conf.sendQueue > 0 {
+		queueSize = gate.conf.sendQueue
+	}
+	s := &Session{
+		sessionid: sessionid,
+		conn:      conn,
+		brw:       bufio.NewReadWriter(br, bw),
+		codec:     codec,
+		gate:      gate,
+		sendq:     make(chan []byte, queueSize),
+		sendDone:  make(chan struct{}),
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err == nil {
+			state := tlsConn.ConnectionState()
+			s.tlsState = &state
+		}
+	}
+	go s.writeLoop()
+	return s
+}
+
+// ConnectionState returns the TLS handshake state for this session, or nil
+// for a plaintext connection.
+func (s *Session) ConnectionState() *tls.ConnectionState {
+	return s.tlsState
 }
 
 func (s *Session) ReadFull(buf []byte) error {
@@ -83,12 +522,40 @@ func newGate(source cham.Address) *Gate {
 	gate := new(Gate)
 	gate.rwmutex = new(sync.RWMutex)
 	gate.source = source
+	gate.dest = source.GetService()
 	gate.clinetnum = 0
 	gate.quit = make(chan struct{})
 	gate.sessions = make(map[uint32]*Session)
+	gate.frameHandlers = make(map[uint8]FrameHandler)
+
+	gate.RegisterFrameType(TYPE_DATA, gate.handleData)
+	gate.RegisterFrameType(TYPE_KEEPALIVE, handleKeepalive)
+	gate.RegisterFrameType(TYPE_CLOSE, handleClose)
 	return gate
 }
 
+// RegisterFrameType lets services attached to the gate add their own
+// message types on top of the built-in TYPE_DATA/TYPE_KEEPALIVE/TYPE_CLOSE.
+func (g *Gate) RegisterFrameType(t uint8, handler FrameHandler) {
+	g.rwmutex.Lock()
+	g.frameHandlers[t] = handler
+	g.rwmutex.Unlock()
+}
+
+func (g *Gate) handleData(s *Session, data []byte) error {
+	msg := cham.NewMsg(0, 0, cham.PTYPE_CLIENT, NewClientMsg(s.sessionid, data))
+	g.dest.Push(msg)
+	return nil
+}
+
+func handleKeepalive(s *Session, data []byte) error {
+	return nil
+}
+
+func handleClose(s *Session, data []byte) error {
+	return errSessionClosed
+}
+
 func newBufioReader(r io.Reader) *bufio.Reader {
 	if v := bufioReaderPool.Get(); v != nil {
 		br := v.(*bufio.Reader)
@@ -119,20 +586,157 @@ func putBufioWriter(w *bufio.Writer) {
 
 //gate listen
 func (g *Gate) open(conf *Conf) bool {
-	listen, err := net.Listen("tcp", conf.address)
+	var listen net.Listener
+	var err error
+	if conf.tlsConfig != nil {
+		g.tlsEnabled = true
+		g.tlsConfig.Store(conf.tlsConfig)
+		listen, err = tls.Listen("tcp", conf.address, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return g.tlsConfig.Load().(*tls.Config), nil
+			},
+		})
+	} else {
+		listen, err = net.Listen("tcp", conf.address)
+	}
 	if err != nil {
 		panic("gate open error:" + err.Error())
 	}
+	g.conf = conf
 	g.maxclient = conf.maxclient
+	g.goodbye = conf.goodbye
+	g.listener = listen
 	go g.start(listen)
 
 	return true
 }
 
+// ReloadTLS atomically swaps the TLS config used for new connections, so
+// operators can rotate certs without restarting the gate. Sessions already
+// established keep their existing handshake state.
+func (g *Gate) ReloadTLS(cfg *tls.Config) {
+	if !g.tlsEnabled {
+		return
+	}
+	g.tlsConfig.Store(cfg)
+}
+
+// SessionInfo returns the authenticated identity metadata for sid so
+// downstream cham.Service handlers know who a ClientMsg came from.
+func (g *Gate) SessionInfo(sid uint32) (SessionInfo, bool) {
+	g.rwmutex.RLock()
+	session, ok := g.sessions[sid]
+	g.rwmutex.RUnlock()
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return SessionInfo{
+		SessionID:     session.sessionid,
+		Authenticated: session.authenticated,
+		AuthTime:      session.authTime,
+	}, true
+}
+
+// authenticate runs the optional challenge/response handshake before a
+// session is registered. The client must reply with
+// HMAC-SHA256(sharedKey, challenge||sessionID) within conf.authTimeout.
+//
+// SetAuth's native challenge is mutually exclusive with a Codec that
+// negotiates its own handshake (WebSocket's HTTP upgrade, in particular):
+// the raw challenge bytes would be written onto the socket before the
+// client's upgrade request is read, corrupting it. Such codecs must do
+// their own authentication, so the native challenge is skipped here.
+func (g *Gate) authenticate(session *Session) bool {
+	conf := g.conf
+	if conf == nil || !conf.authRequired {
+		return true
+	}
+	if _, ok := conf.codec.(handshaker); ok {
+		return true
+	}
+
+	if conf.authTimeout > 0 {
+		session.conn.SetDeadline(time.Now().Add(conf.authTimeout))
+		defer session.conn.SetDeadline(time.Time{})
+	}
+
+	challenge := make([]byte, authChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return false
+	}
+	if _, err := session.brw.Write(challenge); err != nil {
+		return false
+	}
+	if err := session.brw.Flush(); err != nil {
+		return false
+	}
+
+	reply := make([]byte, authReplySize)
+	if err := session.ReadFull(reply); err != nil {
+		return false
+	}
+
+	sidbuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(sidbuf, session.sessionid)
+	mac := hmac.New(sha256.New, conf.sharedKey)
+	mac.Write(challenge)
+	mac.Write(sidbuf)
+	want := mac.Sum(nil)
+
+	if !hmac.Equal(reply, want) {
+		return false
+	}
+	session.authenticated = true
+	session.authTime = time.Now()
+	return true
+}
+
 func (g *Gate) close() {
 	close(g.quit)
 }
 
+// Shutdown stops accepting new connections, gives every open native-protocol
+// session a TYPE_CLOSE frame (carrying Conf.goodbye, if set) to let it
+// disconnect on its own, then waits for ctx to expire or every session to
+// drain before forcing the remaining sockets closed. It always waits for
+// every serve goroutine to actually exit before returning. Conf.goodbye has
+// no effect on a codec-configured gate: a Codec has no TYPE_CLOSE concept
+// of its own, so those sessions are simply closed once draining ends.
+func (g *Gate) Shutdown(ctx context.Context) error {
+	close(g.quit)
+	if g.listener != nil {
+		g.listener.Close()
+	}
+
+	if g.codec() == nil {
+		goodbye := encodeFrame(TYPE_CLOSE, g.goodbye)
+		for _, session := range g.snapshotSessions() {
+			g.enqueue(session, goodbye)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	g.ForEachSession(func(session *Session) bool {
+		session.conn.Close()
+		return true
+	})
+	g.wg.Wait()
+
+	return err
+}
+
 func (g *Gate) start(listen net.Listener) {
 	defer listen.Close()
 	var sessionId uint32 = 0
@@ -147,37 +751,126 @@ func (g *Gate) start(listen net.Listener) {
 			}
 			if g.maxclient != 0 && g.clinetnum >= g.maxclient {
 				conn.Close()
+				continue
 			}
 			g.clinetnum++
 			sid := atomic.AddUint32(&sessionId, 1)
-			session := newSession(sid, conn)
-			g.rwmutex.Lock()
-			g.sessions[sid] = session
-			g.rwmutex.Unlock()
-			go g.serve(session)
+			g.wg.Add(1)
+			go g.accept(sid, conn)
 		}
 	}
 }
 
-// bigendian 2byte length+data
+// accept does the per-connection setup that can block on the network — the
+// TLS handshake (in newSession) and the auth challenge/response — off the
+// accept loop, so one slow or malicious client can't stall every other
+// pending connection. The session is only published into g.sessions, and
+// handed to serve, once authentication succeeds. A failed TLS handshake is
+// not checked here; it only leaves ConnectionState nil, and the session's
+// first read then fails and closes it.
+func (g *Gate) accept(sid uint32, conn net.Conn) {
+	defer g.wg.Done()
+	session := newSession(sid, conn, g.conf.codec, g)
+	if !g.authenticate(session) {
+		session.Close()
+		return
+	}
+	g.rwmutex.Lock()
+	g.sessions[sid] = session
+	g.rwmutex.Unlock()
+	g.serve(session)
+}
+
+// serve reads frames off the session until it errors or the gate closes it.
+// Sessions with a Codec speak plain payload-in/payload-out framing; sessions
+// without one speak the native magic+type+length control protocol.
 func (g *Gate) serve(session *Session) {
-	head := make([]byte, 2)
-	dest := g.source.GetService()
+	if session.codec != nil {
+		g.serveCodec(session)
+		return
+	}
+	g.serveNative(session)
+}
+
+// serveCodec is the payload-only path used by LenPrefix16/32 and WebSocket
+// sessions: every frame is treated as TYPE_DATA, there is no control-frame
+// multiplexing.
+func (g *Gate) serveCodec(session *Session) {
+	if hs, ok := session.codec.(handshaker); ok {
+		if err := hs.Handshake(session.brw); err != nil {
+			g.closeSession(session)
+			return
+		}
+	}
+	maxFrameSize := g.maxFrameSize()
 	for {
-		if err := session.ReadFull(head); err != nil {
+		data, err := session.codec.ReadFrame(session.brw.Reader, maxFrameSize)
+		if err != nil {
 			g.closeSession(session)
 			return
 		}
+		atomic.AddUint64(&g.bytesRead, uint64(len(data)))
+		msg := cham.NewMsg(0, 0, cham.PTYPE_CLIENT, NewClientMsg(session.sessionid, data))
+		g.dest.Push(msg)
+	}
+}
 
-		length := binary.BigEndian.Uint16(head)
-		data := make([]byte, length, length)
+// maxFrameSize returns the configured cap on a single length-prefixed
+// frame, falling back to defaultMaxFrameSize when the gate has no Conf or
+// Conf.maxFrameSize is unset.
+func (g *Gate) maxFrameSize() int {
+	if g.conf != nil && g.conf.maxFrameSize > 0 {
+		return g.conf.maxFrameSize
+	}
+	return defaultMaxFrameSize
+}
 
-		if err := session.ReadFull(data); err != nil {
+// serveNative is the framed protocol: [magic uint32][type uint8][length
+// uint32], bigendian. the type selects a handler registered via
+// RegisterFrameType; unregistered types (TYPE_UNKNOWN included) are safely
+// skipped by reading length bytes, so readers can always resync.
+func (g *Gate) serveNative(session *Session) {
+	headbuf := make([]byte, frameHeaderLen)
+	maxFrameSize := g.maxFrameSize()
+	for {
+		if _, err := io.ReadFull(session.brw, headbuf); err != nil {
+			g.closeSession(session)
+			return
+		}
+		head := frameHeader{
+			magic:  binary.BigEndian.Uint32(headbuf[0:4]),
+			typ:    headbuf[4],
+			length: binary.BigEndian.Uint32(headbuf[5:9]),
+		}
+		if head.magic != frameMagic {
+			g.closeSession(session)
+			return
+		}
+		if head.length > uint32(maxFrameSize) {
+			// Forged or corrupt length field: close instead of trusting it
+			// with a potentially multi-gigabyte allocation.
+			g.closeSession(session)
+			return
+		}
+
+		data := make([]byte, head.length, head.length)
+		if _, err := io.ReadFull(session.brw, data); err != nil {
+			g.closeSession(session)
+			return
+		}
+		atomic.AddUint64(&g.bytesRead, uint64(len(data)))
+
+		g.rwmutex.RLock()
+		handler, ok := g.frameHandlers[head.typ]
+		g.rwmutex.RUnlock()
+		if !ok {
+			// TYPE_UNKNOWN or any other unregistered type: discard and resync.
+			continue
+		}
+		if err := handler(session, data); err != nil {
 			g.closeSession(session)
 			return
 		}
-		msg := cham.NewMsg(0, 0, cham.PTYPE_CLIENT, NewClientMsg(session.sessionid, data))
-		dest.Push(msg)
 	}
 }
 
@@ -188,42 +881,196 @@ func (g *Gate) closeSession(s *Session) {
 	s.Close()
 }
 
+// kick forces sessionid off the gate by closing its connection, the same
+// as Shutdown does for every session. It deliberately does not call
+// Session.Close() itself: the session's own serve() goroutine is very
+// likely mid-read on s.brw right now (that's exactly what closing conn
+// unblocks), so recycling brw or closing sendq from here would race that
+// goroutine. serve() notices the closed conn, calls closeSession, and
+// Session.Close() does the rest of the teardown from there.
 func (g *Gate) kick(sessionid uint32) {
-	var session *Session
-	var ok bool
 	g.rwmutex.Lock()
-	if session, ok = g.sessions[sessionid]; ok {
+	session, ok := g.sessions[sessionid]
+	if ok {
 		delete(g.sessions, sessionid)
 	}
 	g.rwmutex.Unlock()
 	if ok {
-		session.Close()
+		session.conn.Close()
 	}
 }
 
-func (g *Gate) Write(msg *ClientMsg) {
+// Write queues msg.data on its session's writer goroutine. It reports false
+// if the session is unknown or its send queue overflowed (in which case the
+// session is kicked, unless Conf.overflowPolicy is OverflowDropOldest).
+func (g *Gate) Write(msg *ClientMsg) bool {
 	g.rwmutex.RLock()
 	session, ok := g.sessions[msg.session]
 	g.rwmutex.RUnlock()
-	if ok {
-		session.Write(msg.data)
+	if !ok {
+		return false
+	}
+	return session.WriteFrame(msg.data)
+}
+
+// Stats returns a snapshot of the gate's cumulative counters.
+func (g *Gate) Stats() Stats {
+	return Stats{
+		SessionsDropped:        atomic.LoadUint64(&g.sessionsDropped),
+		FramesDroppedQueueFull: atomic.LoadUint64(&g.framesDroppedQueueFull),
+		BytesWritten:           atomic.LoadUint64(&g.bytesWritten),
+		BytesRead:              atomic.LoadUint64(&g.bytesRead),
+	}
+}
+
+// enqueue is the single non-blocking write path used by Write, Broadcast and
+// Multicast. On overflow it either drops the oldest queued frame to make
+// room (OverflowDropOldest) or kicks the session itself and reports false
+// (OverflowKick, the default, or when the retry after dropping also fails).
+func (g *Gate) enqueue(session *Session, frame []byte) bool {
+	select {
+	case session.sendq <- frame:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&g.framesDroppedQueueFull, 1)
+	if g.conf != nil && g.conf.overflowPolicy == OverflowDropOldest {
+		select {
+		case <-session.sendq:
+		default:
+		}
+		select {
+		case session.sendq <- frame:
+			return true
+		default:
+		}
+	}
+
+	atomic.AddUint64(&g.sessionsDropped, 1)
+	g.kick(session.sessionid)
+	return false
+}
+
+// encodeFrame builds a single native frame of type typ so it can be handed, unchanged,
+// to every session's queue instead of being re-encoded per session.
+func encodeFrame(typ uint8, data []byte) []byte {
+	frame := make([]byte, frameHeaderLen+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], frameMagic)
+	frame[4] = typ
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(data)))
+	copy(frame[frameHeaderLen:], data)
+	return frame
+}
+
+// ForEachSession iterates every session under the read lock. Returning
+// false from fn stops the iteration early. fn must not call back into Gate
+// methods that take rwmutex (enqueue, kick, SessionInfo, ...): on overflow
+// enqueue calls kick, which takes the write lock, and a write lock pending
+// behind this read lock would deadlock against itself.
+func (g *Gate) ForEachSession(fn func(*Session) bool) {
+	g.rwmutex.RLock()
+	defer g.rwmutex.RUnlock()
+	for _, session := range g.sessions {
+		if !fn(session) {
+			return
+		}
+	}
+}
+
+// snapshotSessions copies every session under the read lock and returns,
+// releasing the lock before the caller touches any session. Use this
+// instead of ForEachSession when the per-session work may call enqueue,
+// since enqueue can call kick, which needs the write lock.
+func (g *Gate) snapshotSessions() []*Session {
+	g.rwmutex.RLock()
+	sessions := make([]*Session, 0, len(g.sessions))
+	for _, session := range g.sessions {
+		sessions = append(sessions, session)
+	}
+	g.rwmutex.RUnlock()
+	return sessions
+}
+
+// codec returns the gate's configured Codec, or nil for the native
+// protocol. Every session on a gate shares the same codec (set once from
+// Conf at newSession time), so Broadcast/Multicast/Shutdown can encode one
+// frame for the whole gate instead of per session.
+func (g *Gate) codec() Codec {
+	if g.conf == nil {
+		return nil
+	}
+	return g.conf.codec
+}
+
+// Broadcast encodes data once and fans it out to every session's bounded
+// send queue. A session whose queue is already full is kicked (or has its
+// oldest frame dropped, per Conf.overflowPolicy) rather than allowed to
+// stall the broadcast.
+func (g *Gate) Broadcast(data []byte) {
+	frame, err := encodeWithCodec(g.codec(), TYPE_DATA, data)
+	if err != nil {
+		return
+	}
+	for _, session := range g.snapshotSessions() {
+		g.enqueue(session, frame)
+	}
+}
+
+// Multicast is Broadcast restricted to the given session ids.
+func (g *Gate) Multicast(sessionIDs []uint32, data []byte) {
+	frame, err := encodeWithCodec(g.codec(), TYPE_DATA, data)
+	if err != nil {
+		return
+	}
+
+	g.rwmutex.RLock()
+	sessions := make([]*Session, 0, len(sessionIDs))
+	for _, sid := range sessionIDs {
+		if session, ok := g.sessions[sid]; ok {
+			sessions = append(sessions, session)
+		}
+	}
+	g.rwmutex.RUnlock()
+
+	for _, session := range sessions {
+		g.enqueue(session, frame)
+	}
+}
+
+// KickWhere kicks every session pred matches and returns how many were kicked.
+func (g *Gate) KickWhere(pred func(*Session) bool) int {
+	var matched []uint32
+	g.ForEachSession(func(session *Session) bool {
+		if pred(session) {
+			matched = append(matched, session.sessionid)
+		}
+		return true
+	})
+	for _, sid := range matched {
+		g.kick(sid)
 	}
+	return len(matched)
 }
 
 func GateResponseDispatch(service *cham.Service, session int32, source cham.Address, ptype uint8, args ...interface{}) []interface{} {
 	msg := args[0].(*ClientMsg)
+	gatesMutex.RLock()
 	gate := GATES[source]
+	gatesMutex.RUnlock()
 	gate.Write(msg)
 	return cham.NORET
 }
 
 func GateDispatch(service *cham.Service, session int32, source cham.Address, ptype uint8, args ...interface{}) []interface{} {
+	gatesMutex.Lock()
 	gate, ok := GATES[source]
 	if !ok {
 		service.RegisterProtocol(cham.PTYPE_RESPONSE, GateResponseDispatch)
 		gate = newGate(source)
 		GATES[source] = gate
 	}
+	gatesMutex.Unlock()
 
 	return cham.NORET
 }
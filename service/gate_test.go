@@ -0,0 +1,132 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestServeNativeRejectsOversizedFrame verifies that a frame header
+// claiming more than Conf.maxFrameSize closes the session instead of
+// trusting the length field with an allocation.
+func TestServeNativeRejectsOversizedFrame(t *testing.T) {
+	gate := &Gate{
+		rwmutex:       new(sync.RWMutex),
+		sessions:      make(map[uint32]*Session),
+		frameHandlers: make(map[uint8]FrameHandler),
+		conf:          &Conf{maxFrameSize: 16},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	session := newSession(1, server, nil, gate)
+	gate.sessions[1] = session
+
+	done := make(chan struct{})
+	go func() {
+		gate.serveNative(session)
+		close(done)
+	}()
+
+	head := make([]byte, frameHeaderLen)
+	binary.BigEndian.PutUint32(head[0:4], frameMagic)
+	head[4] = TYPE_DATA
+	binary.BigEndian.PutUint32(head[5:9], 1<<20) // well over maxFrameSize
+	client.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(head); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serveNative did not close the session on an oversized frame")
+	}
+
+	gate.rwmutex.RLock()
+	_, stillTracked := gate.sessions[1]
+	gate.rwmutex.RUnlock()
+	if stillTracked {
+		t.Fatal("oversized-frame session should have been removed from gate.sessions")
+	}
+}
+
+// TestAuthenticateAcceptsValidHMAC drives the HMAC challenge/response
+// handshake end to end over a net.Pipe and checks a correctly computed
+// reply is accepted.
+func TestAuthenticateAcceptsValidHMAC(t *testing.T) {
+	sharedKey := []byte("topsecret")
+	gate := &Gate{
+		rwmutex: new(sync.RWMutex),
+		conf:    &Conf{authRequired: true, sharedKey: sharedKey, authTimeout: time.Second},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	session := newSession(42, server, nil, gate)
+	defer session.Close()
+
+	result := make(chan bool, 1)
+	go func() { result <- gate.authenticate(session) }()
+
+	challenge := make([]byte, authChallengeSize)
+	if _, err := io.ReadFull(client, challenge); err != nil {
+		t.Fatalf("read challenge: %v", err)
+	}
+	sidbuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(sidbuf, session.sessionid)
+	mac := hmac.New(sha256.New, sharedKey)
+	mac.Write(challenge)
+	mac.Write(sidbuf)
+	if _, err := client.Write(mac.Sum(nil)); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+
+	select {
+	case ok := <-result:
+		if !ok {
+			t.Fatal("authenticate rejected a correctly computed HMAC reply")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("authenticate did not return")
+	}
+}
+
+// TestAuthenticateRejectsBadHMAC checks that a reply that doesn't match
+// HMAC-SHA256(sharedKey, challenge||sessionID) is rejected.
+func TestAuthenticateRejectsBadHMAC(t *testing.T) {
+	gate := &Gate{
+		rwmutex: new(sync.RWMutex),
+		conf:    &Conf{authRequired: true, sharedKey: []byte("topsecret"), authTimeout: time.Second},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	session := newSession(7, server, nil, gate)
+	defer session.Close()
+
+	result := make(chan bool, 1)
+	go func() { result <- gate.authenticate(session) }()
+
+	challenge := make([]byte, authChallengeSize)
+	if _, err := io.ReadFull(client, challenge); err != nil {
+		t.Fatalf("read challenge: %v", err)
+	}
+	if _, err := client.Write(make([]byte, authReplySize)); err != nil {
+		t.Fatalf("write bogus reply: %v", err)
+	}
+
+	select {
+	case ok := <-result:
+		if ok {
+			t.Fatal("authenticate accepted a bogus HMAC reply")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("authenticate did not return")
+	}
+}